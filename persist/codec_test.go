@@ -0,0 +1,52 @@
+package persist
+
+import (
+	"testing"
+)
+
+type codecTestBlock struct {
+	Height       uint64
+	Transactions [][]byte
+}
+
+// TestSaveLoadWithCodec round-trips a block-sized struct through both
+// JSONCodec and SiaCodec.
+func TestSaveLoadWithCodec(t *testing.T) {
+	meta := Metadata{"Codec Test Block", "v1"}
+	block := codecTestBlock{Height: 1234}
+	for i := 0; i < 2000; i++ {
+		block.Transactions = append(block.Transactions, []byte("transaction data"))
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, SiaCodec{}} {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			mfs := NewMemFS()
+			if err := SaveWithCodecWithFS(mfs, meta, codec, block, "block.dat"); err != nil {
+				t.Fatal(err)
+			}
+			var got codecTestBlock
+			if err := LoadWithCodecWithFS(mfs, meta, codec, &got, "block.dat"); err != nil {
+				t.Fatal(err)
+			}
+			if got.Height != block.Height || len(got.Transactions) != len(block.Transactions) {
+				t.Errorf("round trip mismatch: got %+v", got)
+			}
+		})
+	}
+}
+
+// TestCodecMismatch checks that loading a file with the wrong codec
+// fails with ErrCodecMismatch instead of a confusing unmarshal error.
+func TestCodecMismatch(t *testing.T) {
+	meta := Metadata{"Codec Mismatch Test", "v1"}
+	mfs := NewMemFS()
+	if err := SaveWithCodecWithFS(mfs, meta, SiaCodec{}, codecTestBlock{Height: 1}, "block.dat"); err != nil {
+		t.Fatal(err)
+	}
+	var got codecTestBlock
+	err := LoadWithCodecWithFS(mfs, meta, JSONCodec{}, &got, "block.dat")
+	if err != ErrCodecMismatch {
+		t.Errorf("expected ErrCodecMismatch, got %v", err)
+	}
+}
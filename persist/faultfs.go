@@ -0,0 +1,153 @@
+package persist
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// Fault describes a single failure to inject into a FaultFS. Op names one
+// of the FS/File methods ("OpenFile", "Write", "Sync", "Rename", "Remove",
+// "Stat", "SyncDir"). Match, if non-empty, restricts the fault to filenames
+// containing that substring. Skip lets the first N matching calls
+// through unharmed before the fault triggers on call N+1. If Err is set,
+// the call returns Err. If Truncate is non-zero and Op is "Write", the
+// call silently writes only the first Truncate bytes of p and reports
+// success, simulating a short write left behind by a crash or a full
+// disk. A "Sync" fault with no Err skips the underlying fsync and
+// reports success, simulating an fsync that never reached the disk.
+type Fault struct {
+	Op       string
+	Match    string
+	Skip     int
+	Err      error
+	Truncate int
+}
+
+// FaultFS wraps an FS and lets a test program it to fail a specific
+// operation on the Nth matching call, or to truncate a write mid-way,
+// without having to actually induce ENOSPC/EIO/power-loss on a real
+// filesystem.
+type FaultFS struct {
+	fs     FS
+	mu     sync.Mutex
+	faults []Fault
+	counts map[string]int
+}
+
+// NewFaultFS returns a FaultFS that otherwise behaves like the
+// supplied FS until faults are programmed into it.
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{
+		fs:     fs,
+		counts: make(map[string]int),
+	}
+}
+
+// Inject adds a fault to the FaultFS's programmed fault table.
+func (ffs *FaultFS) Inject(f Fault) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	ffs.faults = append(ffs.faults, f)
+}
+
+// trigger reports whether the fault table has a fault matching op/name
+// ready to fire, consuming one "skip" if it is not yet due. It returns
+// the fault and true if the caller should apply it now.
+func (ffs *FaultFS) trigger(op, name string) (Fault, bool) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	for i := range ffs.faults {
+		f := ffs.faults[i]
+		if f.Op != op || (f.Match != "" && !strings.Contains(name, f.Match)) {
+			continue
+		}
+		key := f.Op + "|" + f.Match
+		ffs.counts[key]++
+		if ffs.counts[key] <= f.Skip {
+			continue
+		}
+		// Fault fires exactly once per Inject call.
+		ffs.faults = append(ffs.faults[:i], ffs.faults[i+1:]...)
+		return f, true
+	}
+	return Fault{}, false
+}
+
+// OpenFile implements FS.OpenFile.
+func (ffs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if f, ok := ffs.trigger("OpenFile", name); ok && f.Err != nil {
+		return nil, f.Err
+	}
+	underlying, err := ffs.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{ffs: ffs, name: name, File: underlying}, nil
+}
+
+// Remove implements FS.Remove.
+func (ffs *FaultFS) Remove(name string) error {
+	if f, ok := ffs.trigger("Remove", name); ok && f.Err != nil {
+		return f.Err
+	}
+	return ffs.fs.Remove(name)
+}
+
+// Rename implements FS.Rename.
+func (ffs *FaultFS) Rename(oldname, newname string) error {
+	if f, ok := ffs.trigger("Rename", newname); ok && f.Err != nil {
+		return f.Err
+	}
+	return ffs.fs.Rename(oldname, newname)
+}
+
+// Stat implements FS.Stat.
+func (ffs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if f, ok := ffs.trigger("Stat", name); ok && f.Err != nil {
+		return nil, f.Err
+	}
+	return ffs.fs.Stat(name)
+}
+
+// SyncDir implements FS.SyncDir.
+func (ffs *FaultFS) SyncDir(dir string) error {
+	if f, ok := ffs.trigger("SyncDir", dir); ok && f.Err != nil {
+		return f.Err
+	}
+	return ffs.fs.SyncDir(dir)
+}
+
+// faultFile wraps a File so that Write and Sync can also have faults
+// injected into them.
+type faultFile struct {
+	File
+	ffs  *FaultFS
+	name string
+}
+
+// Write implements File.Write.
+func (f *faultFile) Write(p []byte) (int, error) {
+	if fault, ok := f.ffs.trigger("Write", f.name); ok {
+		if fault.Truncate > 0 && fault.Truncate < len(p) {
+			n, err := f.File.Write(p[:fault.Truncate])
+			if err != nil {
+				return n, err
+			}
+			return n, nil
+		}
+		if fault.Err != nil {
+			return 0, fault.Err
+		}
+	}
+	return f.File.Write(p)
+}
+
+// Sync implements File.Sync.
+func (f *faultFile) Sync() error {
+	if fault, ok := f.ffs.trigger("Sync", f.name); ok {
+		// With no Err, the fsync is dropped but reported as done.
+		return fault.Err
+	}
+	return f.File.Sync()
+}
@@ -0,0 +1,88 @@
+package persist
+
+import (
+	"sync"
+	"testing"
+)
+
+type fileTestStruct struct {
+	Counter int
+}
+
+// TestFileSaveLoadInterleaved fires many concurrent Saves and Loads
+// against one LockedFile, which already holds a valid save, and checks
+// that every Load succeeds - never a torn read of a write that was only
+// half finished, which the old panic-based detector
+// could never guarantee since it didn't serialize Load against Save at
+// all.
+func TestFileSaveLoadInterleaved(t *testing.T) {
+	mfs := NewMemFS()
+	lf, err := NewFileWithFS(mfs, "obj.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := Metadata{"File Test Struct", "v1"}
+
+	if err := lf.Save(meta, fileTestStruct{Counter: -1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 500)
+	for i := 0; i < 250; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := lf.Save(meta, fileTestStruct{Counter: i}); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	for i := 0; i < 250; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var obj fileTestStruct
+			if err := lf.Load(meta, &obj); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent Save/Load failed: %v", err)
+	}
+
+	var final fileTestStruct
+	if err := lf.Load(meta, &final); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestFileTrySave checks that TrySave returns ErrConcurrentSave instead
+// of blocking when another Save already holds the file's lock.
+func TestFileTrySave(t *testing.T) {
+	mfs := NewMemFS()
+	lf, err := NewFileWithFS(mfs, "obj.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := Metadata{"File Test Struct", "v1"}
+
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	if err := lf.TrySave(meta, fileTestStruct{Counter: 1}); err != ErrConcurrentSave {
+		t.Errorf("expected ErrConcurrentSave, got %v", err)
+	}
+}
+
+// TestNewFileRejectsTempSuffix checks that NewFile refuses to bind to a
+// temp-suffixed filename, the same way Load does.
+func TestNewFileRejectsTempSuffix(t *testing.T) {
+	mfs := NewMemFS()
+	if _, err := NewFileWithFS(mfs, "obj.json"+tempSuffix); err != ErrBadFilenameSuffix {
+		t.Errorf("expected ErrBadFilenameSuffix, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package persist
+
+import (
+	"io"
+	"os"
+)
+
+// File is the subset of *os.File that the persist package needs from an
+// open file handle. It is satisfied by *os.File as well as the in-memory
+// handles returned by MemFS.
+type File interface {
+	io.ReadWriteCloser
+	Sync() error
+}
+
+// FS defines the filesystem operations that SaveJSON and LoadJSON perform
+// in order to durably write and read data. osFS is the default,
+// production implementation, forwarding every call to the os package.
+// Tests substitute MemFS or FaultFS so that the atomic-rename and
+// crash-recovery invariants this package claims to provide can be
+// exercised without touching disk or relying on hand-crafted testdata.
+type FS interface {
+	// OpenFile opens the named file with the given flag and permissions,
+	// creating it if os.O_CREATE is set.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// Remove deletes the named file.
+	Remove(name string) error
+	// Rename atomically replaces newname with oldname, the same way
+	// os.Rename does on POSIX systems.
+	Rename(oldname, newname string) error
+	// Stat returns file info for the named file.
+	Stat(name string) (os.FileInfo, error)
+	// SyncDir fsyncs the named directory. On POSIX systems a Rename's
+	// directory entry is only guaranteed durable once the directory
+	// itself has been fsynced - writeContainerLocked calls this after
+	// every Rename so that a power loss right after a save can't leave
+	// the rename undone even though the renamed-to file's own data was
+	// fsynced before the rename.
+	SyncDir(dir string) error
+}
+
+// osFS is the default FS implementation, backed by the os package.
+type osFS struct{}
+
+// OpenFile implements FS.OpenFile.
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+// Remove implements FS.Remove.
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Rename implements FS.Rename.
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+// Stat implements FS.Stat.
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// SyncDir implements FS.SyncDir by opening dir and fsyncing it directly,
+// the standard way to flush a directory's entries on POSIX systems; there
+// is no os.SyncDir, so this is os.Open+File.Sync rather than a single
+// os package call.
+func (osFS) SyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// defaultFS is the FS used by SaveJSON and LoadJSON.
+var defaultFS FS = osFS{}
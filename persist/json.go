@@ -0,0 +1,289 @@
+package persist
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// persistDir is the directory, relative to a module's persist
+	// directory, that temporary test data is written to.
+	persistDir = "persist"
+
+	// tempSuffix is appended to a filename to produce the path that
+	// SaveJSON writes to before atomically renaming it into place.
+	tempSuffix = "_temp"
+)
+
+var (
+	// ErrBadFilenameSuffix is returned when LoadJSON is called directly
+	// on a temp file. Callers should always load the canonical filename;
+	// LoadJSON consults the temp file itself if the canonical file is
+	// missing or corrupted.
+	ErrBadFilenameSuffix = errors.New("persist: cannot load a file with the temp suffix directly")
+
+	// ErrBadHeader is returned when a loaded file's header does not
+	// match the header the caller expected.
+	ErrBadHeader = errors.New("persist: expected different header")
+
+	// ErrBadVersion is returned when a loaded file's version does not
+	// match the version the caller expected and no migrations at all are
+	// registered for its header. If some are registered but none bridge
+	// the gap, ErrNoMigrationPath is returned instead.
+	ErrBadVersion = errors.New("persist: expected different version")
+
+	// errChecksumMismatch is returned internally when a file's checksum,
+	// or its header/data framing, doesn't check out. Load falls back to
+	// the temp copy first, so it only reaches the caller when the temp
+	// copy is unusable too.
+	errChecksumMismatch = errors.New("persist: checksum mismatch")
+)
+
+// Metadata contains the header and version of the data being stored. It
+// is written alongside the data itself so that Load can recognize data
+// from a previous version of a struct and migrate or reject it instead
+// of silently misinterpreting it.
+type Metadata struct {
+	Header  string
+	Version string
+}
+
+// fileHeader is the JSON preamble written before a file's codec-encoded
+// data: `header-json "\n" data`. Keeping it plain JSON regardless of
+// which Codec produced Data means LoadWithCodec can always tell what
+// wrote a file - and refuse a codec mismatch with a clear error - before
+// it ever asks a codec to decode bytes it doesn't understand.
+type fileHeader struct {
+	Metadata
+	Codec    string `json:"codec"`
+	Checksum string `json:"checksum,omitempty"`
+	Length   int    `json:"length"`
+}
+
+// SaveJSON saves a json marshaling of object to filename, using the
+// default filesystem. It is a thin wrapper around SaveWithCodec using
+// JSONCodec.
+func SaveJSON(meta Metadata, object interface{}, filename string) error {
+	return SaveJSONWithFS(defaultFS, meta, object, filename)
+}
+
+// SaveJSONWithFS is SaveJSON using a caller-supplied FS, for testing.
+func SaveJSONWithFS(fs FS, meta Metadata, object interface{}, filename string) error {
+	return SaveWithCodecWithFS(fs, meta, JSONCodec{}, object, filename)
+}
+
+// LoadJSON loads a json encoded object from filename using the default
+// filesystem. It is a thin wrapper around LoadWithCodec using JSONCodec.
+func LoadJSON(meta Metadata, object interface{}, filename string) error {
+	return LoadJSONWithFS(defaultFS, meta, object, filename)
+}
+
+// LoadJSONWithFS is LoadJSON using a caller-supplied FS, for testing.
+func LoadJSONWithFS(fs FS, meta Metadata, object interface{}, filename string) error {
+	return LoadWithCodecWithFS(fs, meta, JSONCodec{}, object, filename)
+}
+
+// SaveWithCodec saves v to filename using codec, through the default
+// filesystem.
+func SaveWithCodec(meta Metadata, codec Codec, v interface{}, filename string) error {
+	return SaveWithCodecWithFS(defaultFS, meta, codec, v, filename)
+}
+
+// SaveWithCodecWithFS saves v to filename using codec, through fs. The
+// write is atomic: the encoded file is first written to a temp file
+// which is fsynced and then renamed over filename, so that a crash at
+// any point leaves either the old filename intact or the temp file
+// available for LoadWithCodecWithFS to recover from.
+func SaveWithCodecWithFS(fs FS, meta Metadata, codec Codec, v interface{}, filename string) error {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeContainer(fs, meta, codec.Name(), data, filename)
+}
+
+// writeContainer atomically writes data, already encoded by some codec,
+// wrapped in a fileHeader carrying meta, codecName and a checksum. It is
+// the shared commit path for every Save* function, for rewriting a file
+// Load* has just migrated, and for Migrate. It holds filename's lock for
+// the duration of the write, so that two goroutines saving the same
+// filename serialize instead of racing on the shared temp file.
+func writeContainer(fs FS, meta Metadata, codecName string, data []byte, filename string) error {
+	mu := fileLock(filename)
+	mu.Lock()
+	defer mu.Unlock()
+	return writeContainerLocked(fs, meta, codecName, data, filename)
+}
+
+// writeContainerLocked is writeContainer without acquiring filename's
+// lock, for callers that already hold it (LockedFile's methods share the
+// same *sync.RWMutex writeContainer would otherwise try to re-acquire).
+func writeContainerLocked(fs FS, meta Metadata, codecName string, data []byte, filename string) error {
+	sum := sha256.Sum256(data)
+	hdr := fileHeader{
+		Metadata: meta,
+		Codec:    codecName,
+		Checksum: hex.EncodeToString(sum[:]),
+		Length:   len(data),
+	}
+	hdrBytes, err := json.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+	full := make([]byte, 0, len(hdrBytes)+1+len(data))
+	full = append(full, hdrBytes...)
+	full = append(full, '\n')
+	full = append(full, data...)
+
+	tempFilename := filename + tempSuffix
+	f, err := fs.OpenFile(tempFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(full); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tempFilename, filename); err != nil {
+		return err
+	}
+	// The rename is only durable once the directory it landed in has
+	// itself been fsynced; without this, a crash right after a
+	// successful rename could still roll back to the pre-rename
+	// directory state on some filesystems.
+	return fs.SyncDir(filepath.Dir(filename))
+}
+
+// LoadWithCodec loads v from filename using codec, through the default
+// filesystem.
+func LoadWithCodec(meta Metadata, codec Codec, v interface{}, filename string) error {
+	return LoadWithCodecWithFS(defaultFS, meta, codec, v, filename)
+}
+
+// LoadWithCodecWithFS loads v from filename using codec, through fs,
+// verifying that the stored Metadata, codec name, and checksum match
+// expectations. If filename is missing or corrupted, it falls back to
+// filename+tempSuffix, which writeContainer leaves behind whenever a
+// crash happens between writing the temp file and renaming it into
+// place.
+//
+// If the file on disk is older than meta.Version, LoadWithCodecWithFS
+// walks the graph registered with RegisterMigration to bring it up to
+// date, rewriting the file with the upgraded data before returning, the
+// same way it completes an interrupted rename recovered from the temp
+// copy.
+func LoadWithCodecWithFS(fs FS, meta Metadata, codec Codec, v interface{}, filename string) error {
+	if strings.HasSuffix(filename, tempSuffix) {
+		return ErrBadFilenameSuffix
+	}
+
+	hdr, data, foundAt, err := loadContainer(fs, meta.Header, filename)
+	if err != nil {
+		return err
+	}
+	if hdr.Codec != codec.Name() {
+		return ErrCodecMismatch
+	}
+
+	if hdr.Version != meta.Version {
+		data, err = migrate(meta.Header, hdr.Version, meta.Version, data)
+		if err != nil {
+			return err
+		}
+		if err := writeContainer(fs, meta, codec.Name(), data, filename); err != nil {
+			return err
+		}
+	} else if foundAt != filename {
+		// Recovered from the temp copy left behind by an interrupted
+		// save; finish the commit so future loads hit the fast path.
+		_ = fs.Rename(foundAt, filename)
+	}
+	return codec.Unmarshal(data, v)
+}
+
+// loadContainer reads and validates the fileHeader and data for header
+// stored at filename, falling back to filename+tempSuffix if filename is
+// missing or corrupted. It returns the path the valid copy was actually
+// found at, so callers can tell whether a recovery happened. It holds
+// filename's lock for the duration of the read, so a concurrent save
+// cannot be observed half-written.
+func loadContainer(fs FS, header, filename string) (fileHeader, []byte, string, error) {
+	mu := fileLock(filename)
+	mu.RLock()
+	defer mu.RUnlock()
+	return loadContainerLocked(fs, header, filename)
+}
+
+// loadContainerLocked is loadContainer without acquiring filename's
+// lock, for callers (LockedFile's methods) that manage the lock
+// themselves because they need to upgrade to a write lock partway
+// through, to rewrite a file they find needs migrating.
+func loadContainerLocked(fs FS, header, filename string) (fileHeader, []byte, string, error) {
+	hdr, data, err := readRawContainer(fs, header, filename)
+	if err == nil {
+		return hdr, data, filename, nil
+	}
+
+	tempFilename := filename + tempSuffix
+	hdr, data, tempErr := readRawContainer(fs, header, tempFilename)
+	if tempErr != nil {
+		// Neither copy is usable; surface whichever error concerns the
+		// canonical file, since that's the one the caller asked for.
+		return fileHeader{}, nil, "", err
+	}
+	return hdr, data, tempFilename, nil
+}
+
+// readRawContainer reads the fileHeader and data stored at filename and
+// verifies the file's header and checksum, but not its version: Load*
+// and Migrate need to see an older version in order to upgrade it. A
+// missing checksum (as written by code that predates this package, or
+// crafted by hand) is treated as trusted and is not verified.
+func readRawContainer(fs FS, header, filename string) (fileHeader, []byte, error) {
+	f, err := fs.OpenFile(filename, os.O_RDONLY, 0)
+	if err != nil {
+		return fileHeader{}, nil, err
+	}
+	defer f.Close()
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fileHeader{}, nil, err
+	}
+
+	idx := bytes.IndexByte(raw, '\n')
+	if idx < 0 {
+		return fileHeader{}, nil, errChecksumMismatch
+	}
+	var hdr fileHeader
+	if err := json.Unmarshal(raw[:idx], &hdr); err != nil {
+		return fileHeader{}, nil, err
+	}
+	data := raw[idx+1:]
+	if len(data) != hdr.Length {
+		return fileHeader{}, nil, errChecksumMismatch
+	}
+	if hdr.Header != header {
+		return fileHeader{}, nil, ErrBadHeader
+	}
+	if hdr.Checksum != "" {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != hdr.Checksum {
+			return fileHeader{}, nil, errChecksumMismatch
+		}
+	}
+	return hdr, data, nil
+}
@@ -2,8 +2,13 @@ package persist
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 
@@ -70,37 +75,26 @@ func TestSaveLoadJSON(t *testing.T) {
 		t.Error("did not get bad filename suffix")
 	}
 
-	// Try saving the object multiple times concurrently.
+	// Try saving the object multiple times concurrently. The file's
+	// per-path mutex (see fileLock) serializes the writes, so every one
+	// of them should succeed - no torn temp files, no lost updates.
 	var wg sync.WaitGroup
-	errs := make([]bool, 250)
+	errs := make([]error, 250)
 	for i := 0; i < 250; i++ {
 		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			defer func() {
-				r := recover() // Error is irrelevant, managed by err slice.
-				if r != nil {
-					errs[i] = true
-				}
-			}()
-			SaveJSON(testMeta, obj1, obj1Filename)
+			errs[i] = SaveJSON(testMeta, obj1, obj1Filename)
 		}(i)
 	}
 	wg.Wait()
-	// At least one of the saves should have complained about concurrent usage.
-	var found bool
-	for i := range errs {
-		if errs[i] {
-			found = true
-			break
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("concurrent save %d failed: %v", i, err)
 		}
 	}
-	if !found {
-		// Single core machines could result in this error.
-		t.Log("File usage overlap detector seems to be ineffective")
-	}
 
-	// Despite the errors, the object should still be readable.
+	// The file should still be readable and correct.
 	err = LoadJSON(testMeta, &obj2, obj1Filename)
 	if err != nil {
 		t.Fatal(err)
@@ -126,149 +120,271 @@ func TestSaveLoadJSON(t *testing.T) {
 	}
 }
 
-// TestLoadJSONCorruptedFiles checks that LoadJSON correctly handles various
-// types of corruption that can occur during the saving process.
+// corruptedFilesTestMeta and corruptedFilesTestStruct are shared by every
+// scenario in TestLoadJSONCorruptedFiles so that each one only has to
+// describe how it mutates an otherwise-valid pair of main/temp files.
+var corruptedFilesTestMeta = Metadata{"Test Struct", "v1.2.1"}
+
+type corruptedFilesTestStruct struct {
+	One   string
+	Two   uint64
+	Three []byte
+}
+
+// saveCorruptedFilesObj writes the canonical test object to filename in
+// mfs, producing a real main file the way SaveJSONWithFS would.
+func saveCorruptedFilesObj(t *testing.T, mfs *MemFS, filename string) corruptedFilesTestStruct {
+	t.Helper()
+	obj := corruptedFilesTestStruct{"dog", 25, []byte("more dog")}
+	if err := SaveJSONWithFS(mfs, corruptedFilesTestMeta, obj, filename); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+// checkCorruptedFilesObj asserts that obj matches the object written by
+// saveCorruptedFilesObj.
+func checkCorruptedFilesObj(t *testing.T, obj corruptedFilesTestStruct) {
+	t.Helper()
+	want := corruptedFilesTestStruct{"dog", 25, []byte("more dog")}
+	if obj.One != want.One || obj.Two != want.Two || !bytes.Equal(obj.Three, want.Three) {
+		t.Errorf("persist mismatch: got %+v, want %+v", obj, want)
+	}
+}
+
+// TestLoadJSONCorruptedFiles checks that LoadJSON correctly handles every
+// type of corruption that can occur during the saving process. Rather
+// than shipping hand-crafted testdata blobs, each scenario is generated
+// on a MemFS by saving a real object and then mutating the main and/or
+// temp copy, so the atomic-rename and recovery invariants SaveJSON/
+// LoadJSON claim to provide are actually exercised.
 func TestLoadJSONCorruptedFiles(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
 	}
-	// Define the test object that will be getting loaded.
-	testMeta := Metadata{"Test Struct", "v1.2.1"}
-	type testStruct struct {
-		One   string
-		Two   uint64
-		Three []byte
-	}
-	obj1 := testStruct{"dog", 25, []byte("more dog")}
-	var obj2 testStruct
+	const filename = "obj.json"
+	tempFilename := filename + tempSuffix
 
-	// Try loading a file with a bad checksum.
-	err := LoadJSON(testMeta, &obj2, filepath.Join("testdata", "badchecksum.json"))
-	if err == nil {
-		t.Error("bad checksum should have failed")
-	}
-	// Try loading a file where only the main has a bad checksum.
-	err = LoadJSON(testMeta, &obj2, filepath.Join("testdata", "badchecksummain.json"))
-	if err != nil {
-		t.Error("bad checksum main failed:", err)
-	}
-	// Verify equivalence.
-	if obj2.One != obj1.One {
-		t.Error("persist mismatch")
-	}
-	if obj2.Two != obj1.Two {
-		t.Error("persist mismatch")
-	}
-	if !bytes.Equal(obj2.Three, obj1.Three) {
-		t.Error("persist mismatch")
-	}
-	if obj2.One != "dog" {
-		t.Error("persist mismatch")
-	}
-	if obj2.Two != 25 {
-		t.Error("persist mismatch")
-	}
-	if !bytes.Equal(obj2.Three, []byte("more dog")) {
-		t.Error("persist mismatch")
-	}
+	// badChecksum: both main and temp have a checksum that doesn't match
+	// their data. LoadJSON should fail.
+	t.Run("BadChecksum", func(t *testing.T) {
+		mfs := NewMemFS()
+		saveCorruptedFilesObj(t, mfs, filename)
+		leaveGoodTempCopy(t, mfs, filename, tempFilename)
+		corruptChecksum(mfs, filename)
+		corruptChecksum(mfs, tempFilename)
+		var obj corruptedFilesTestStruct
+		if err := LoadJSONWithFS(mfs, corruptedFilesTestMeta, &obj, filename); err == nil {
+			t.Error("bad checksum should have failed")
+		}
+	})
 
-	// Try loading a file with a manual checksum.
-	err = LoadJSON(testMeta, &obj2, filepath.Join("testdata", "manual.json"))
-	if err != nil {
-		t.Error("bad checksum should have failed")
-	}
-	// Verify equivalence.
-	if obj2.One != obj1.One {
-		t.Error("persist mismatch")
-	}
-	if obj2.Two != obj1.Two {
-		t.Error("persist mismatch")
-	}
-	if !bytes.Equal(obj2.Three, obj1.Three) {
-		t.Error("persist mismatch")
-	}
-	if obj2.One != "dog" {
-		t.Error("persist mismatch")
-	}
-	if obj2.Two != 25 {
-		t.Error("persist mismatch")
-	}
-	if !bytes.Equal(obj2.Three, []byte("more dog")) {
-		t.Error("persist mismatch")
-	}
+	// badChecksumMain: only main has a bad checksum, but a good temp
+	// copy is left behind (as if a crash hit just before the rename that
+	// commits a later save). LoadJSON should recover from the temp copy.
+	t.Run("BadChecksumMain", func(t *testing.T) {
+		mfs := NewMemFS()
+		saveCorruptedFilesObj(t, mfs, filename)
+		leaveGoodTempCopy(t, mfs, filename, tempFilename)
+		corruptChecksum(mfs, filename)
+		var obj2 corruptedFilesTestStruct
+		if err := LoadJSONWithFS(mfs, corruptedFilesTestMeta, &obj2, filename); err != nil {
+			t.Error("bad checksum main failed:", err)
+		}
+		checkCorruptedFilesObj(t, obj2)
+	})
 
-	// Try loading a corrupted main file.
-	err = LoadJSON(testMeta, &obj2, filepath.Join("testdata", "corruptmain.json"))
-	if err != nil {
-		t.Error("couldn't load corrupted main:", err)
-	}
-	// Verify equivalence.
-	if obj2.One != obj1.One {
-		t.Error("persist mismatch")
-	}
-	if obj2.Two != obj1.Two {
-		t.Error("persist mismatch")
-	}
-	if !bytes.Equal(obj2.Three, obj1.Three) {
-		t.Error("persist mismatch")
-	}
-	if obj2.One != "dog" {
-		t.Error("persist mismatch")
-	}
-	if obj2.Two != 25 {
-		t.Error("persist mismatch")
-	}
-	if !bytes.Equal(obj2.Three, []byte("more dog")) {
-		t.Error("persist mismatch")
-	}
+	// manual: a checksum computed and placed by hand (rather than by
+	// SaveJSON) still verifies correctly as long as it's right.
+	t.Run("ManualChecksum", func(t *testing.T) {
+		mfs := NewMemFS()
+		data, err := json.Marshal(corruptedFilesTestStruct{"dog", 25, []byte("more dog")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		writeManualContainer(t, mfs, filename, hex.EncodeToString(sum[:]), data)
+		var obj corruptedFilesTestStruct
+		if err := LoadJSONWithFS(mfs, corruptedFilesTestMeta, &obj, filename); err != nil {
+			t.Error("manual checksum should have verified:", err)
+		}
+		checkCorruptedFilesObj(t, obj)
+	})
+
+	// corruptMain: main is corrupted but a good temp copy exists.
+	// LoadJSON should recover from the temp copy.
+	t.Run("CorruptMain", func(t *testing.T) {
+		mfs := NewMemFS()
+		saveCorruptedFilesObj(t, mfs, filename)
+		leaveGoodTempCopy(t, mfs, filename, tempFilename)
+		truncate(mfs, filename)
+		var obj corruptedFilesTestStruct
+		if err := LoadJSONWithFS(mfs, corruptedFilesTestMeta, &obj, filename); err != nil {
+			t.Error("couldn't load corrupted main:", err)
+		}
+		checkCorruptedFilesObj(t, obj)
+	})
+
+	// corruptTemp: temp is corrupted but main is fine. LoadJSON should
+	// never need to consult the temp copy at all.
+	t.Run("CorruptTemp", func(t *testing.T) {
+		mfs := NewMemFS()
+		saveCorruptedFilesObj(t, mfs, filename)
+		leaveGoodTempCopy(t, mfs, filename, tempFilename)
+		truncate(mfs, tempFilename)
+		var obj corruptedFilesTestStruct
+		if err := LoadJSONWithFS(mfs, corruptedFilesTestMeta, &obj, filename); err != nil {
+			t.Error("couldn't load main despite corrupted temp:", err)
+		}
+		checkCorruptedFilesObj(t, obj)
+	})
+
+	// noChecksum: main has no checksum at all (as written by code that
+	// predates checksumming) and no temp copy exists. LoadJSON should
+	// trust the contents rather than fail closed.
+	t.Run("NoChecksum", func(t *testing.T) {
+		mfs := NewMemFS()
+		data, err := json.Marshal(corruptedFilesTestStruct{"dog", 25, []byte("more dog")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeManualContainer(t, mfs, filename, "", data)
+		var obj corruptedFilesTestStruct
+		if err := LoadJSONWithFS(mfs, corruptedFilesTestMeta, &obj, filename); err != nil {
+			t.Error("couldn't load no checksum:", err)
+		}
+		checkCorruptedFilesObj(t, obj)
+	})
 
-	// Try loading a corrupted temp file.
-	err = LoadJSON(testMeta, &obj2, filepath.Join("testdata", "corrupttemp.json"))
+	// renamedButUnsynced: a FaultFS drops the Sync call on the temp file,
+	// then a crash lands right after the rename. The rename itself is
+	// atomic, so the (unsynced) data still shows up as the main file;
+	// LoadJSON has no way to tell and isn't expected to - this documents
+	// that SyncOnAppend-style durability is the caller's responsibility,
+	// not LoadJSON's.
+	t.Run("RenamedButUnsynced", func(t *testing.T) {
+		mfs := NewMemFS()
+		ffs := NewFaultFS(mfs)
+		ffs.Inject(Fault{Op: "Sync", Match: tempFilename, Skip: 0, Err: nil})
+		obj1 := corruptedFilesTestStruct{"dog", 25, []byte("more dog")}
+		if err := SaveJSONWithFS(ffs, corruptedFilesTestMeta, obj1, filename); err != nil {
+			t.Fatal(err)
+		}
+		var obj2 corruptedFilesTestStruct
+		if err := LoadJSONWithFS(mfs, corruptedFilesTestMeta, &obj2, filename); err != nil {
+			t.Error("couldn't load after unsynced rename:", err)
+		}
+		checkCorruptedFilesObj(t, obj2)
+	})
+
+	// crashBetweenRenameAndDirSync: the rename itself succeeds, but the
+	// directory fsync that's supposed to make it durable fails (or, on a
+	// real crash, never runs). SaveJSONWithFS must surface that failure
+	// rather than swallowing it, since the caller may want to retry or
+	// treat the save as not yet durable; LoadJSON, loading the data back
+	// through a fault-free FS afterwards, still sees the renamed file,
+	// since the rename itself did complete.
+	t.Run("CrashBetweenRenameAndDirSync", func(t *testing.T) {
+		mfs := NewMemFS()
+		ffs := NewFaultFS(mfs)
+		syncDirErr := errors.New("simulated crash before directory fsync")
+		ffs.Inject(Fault{Op: "SyncDir", Skip: 0, Err: syncDirErr})
+		obj1 := corruptedFilesTestStruct{"dog", 25, []byte("more dog")}
+		if err := SaveJSONWithFS(ffs, corruptedFilesTestMeta, obj1, filename); err != syncDirErr {
+			t.Fatalf("expected the injected SyncDir failure to surface, got %v", err)
+		}
+		var obj2 corruptedFilesTestStruct
+		if err := LoadJSONWithFS(mfs, corruptedFilesTestMeta, &obj2, filename); err != nil {
+			t.Error("rename had already completed, load should still succeed:", err)
+		}
+		checkCorruptedFilesObj(t, obj2)
+	})
+
+	// crashBetweenWriteAndRename: the rename that commits the save never
+	// happens, leaving only a temp copy behind (the way a crash between
+	// the Sync and the Rename would). LoadJSON should recover from it
+	// and finish the commit.
+	t.Run("CrashBetweenWriteAndRename", func(t *testing.T) {
+		mfs := NewMemFS()
+		ffs := NewFaultFS(mfs)
+		ffs.Inject(Fault{Op: "Rename", Match: filename, Skip: 0, Err: errors.New("simulated crash before rename")})
+		obj1 := corruptedFilesTestStruct{"dog", 25, []byte("more dog")}
+		if err := SaveJSONWithFS(ffs, corruptedFilesTestMeta, obj1, filename); err == nil {
+			t.Fatal("expected the injected rename failure to surface")
+		}
+		if _, exists := mfs.ReadFile(filename); exists {
+			t.Fatal("main file should not exist before the crash is recovered from")
+		}
+		var obj2 corruptedFilesTestStruct
+		if err := LoadJSONWithFS(mfs, corruptedFilesTestMeta, &obj2, filename); err != nil {
+			t.Error("couldn't recover from the temp copy:", err)
+		}
+		checkCorruptedFilesObj(t, obj2)
+		if _, exists := mfs.ReadFile(filename); !exists {
+			t.Error("LoadJSON should have completed the interrupted rename")
+		}
+	})
+}
+
+// leaveGoodTempCopy copies the current (valid) contents of filename to
+// tempFilename, simulating the temp file SaveJSON leaves behind when a
+// crash interrupts a later save between the Sync and the Rename.
+func leaveGoodTempCopy(t *testing.T, mfs *MemFS, filename, tempFilename string) {
+	t.Helper()
+	data, exists := mfs.ReadFile(filename)
+	if !exists {
+		t.Fatal("no file to copy from")
+	}
+	mfs.WriteFile(tempFilename, data)
+}
+
+// corruptChecksum rewrites the checksum field of the fileHeader stored at
+// filename so that it no longer matches the data that follows it.
+func corruptChecksum(mfs *MemFS, filename string) {
+	raw, exists := mfs.ReadFile(filename)
+	if !exists {
+		return
+	}
+	idx := bytes.IndexByte(raw, '\n')
+	if idx < 0 {
+		return
+	}
+	var hdr fileHeader
+	if err := json.Unmarshal(raw[:idx], &hdr); err != nil {
+		return
+	}
+	hdr.Checksum = strings.Repeat("f", len(hdr.Checksum))
+	hdrBytes, err := json.Marshal(hdr)
 	if err != nil {
-		t.Error("couldn't load corrupted main:", err)
-	}
-	// Verify equivalence.
-	if obj2.One != obj1.One {
-		t.Error("persist mismatch")
-	}
-	if obj2.Two != obj1.Two {
-		t.Error("persist mismatch")
-	}
-	if !bytes.Equal(obj2.Three, obj1.Three) {
-		t.Error("persist mismatch")
-	}
-	if obj2.One != "dog" {
-		t.Error("persist mismatch")
-	}
-	if obj2.Two != 25 {
-		t.Error("persist mismatch")
-	}
-	if !bytes.Equal(obj2.Three, []byte("more dog")) {
-		t.Error("persist mismatch")
+		return
 	}
+	mfs.WriteFile(filename, append(append(hdrBytes, '\n'), raw[idx+1:]...))
+}
 
-	// Try loading a file with no temp, and no checksum.
-	err = LoadJSON(testMeta, &obj2, filepath.Join("testdata", "nochecksum.json"))
+// writeManualContainer writes a fileHeader/data container to filename by
+// hand, the way LoadJSON's checksum verification needs to accept files
+// it didn't itself write (e.g. from an older build of this package).
+func writeManualContainer(t *testing.T, mfs *MemFS, filename, checksum string, data []byte) {
+	t.Helper()
+	hdr := fileHeader{
+		Metadata: corruptedFilesTestMeta,
+		Codec:    JSONCodec{}.Name(),
+		Checksum: checksum,
+		Length:   len(data),
+	}
+	hdrBytes, err := json.Marshal(hdr)
 	if err != nil {
-		t.Error("couldn't load no checksum:", err)
-	}
-	// Verify equivalence.
-	if obj2.One != obj1.One {
-		t.Error("persist mismatch")
-	}
-	if obj2.Two != obj1.Two {
-		t.Error("persist mismatch")
-	}
-	if !bytes.Equal(obj2.Three, obj1.Three) {
-		t.Error("persist mismatch")
-	}
-	if obj2.One != "dog" {
-		t.Error("persist mismatch")
-	}
-	if obj2.Two != 25 {
-		t.Error("persist mismatch")
-	}
-	if !bytes.Equal(obj2.Three, []byte("more dog")) {
-		t.Error("persist mismatch")
+		t.Fatal(err)
 	}
+	mfs.WriteFile(filename, append(append(hdrBytes, '\n'), data...))
+}
+
+// truncate chops the stored contents of filename in half, simulating a
+// torn write.
+func truncate(mfs *MemFS, filename string) {
+	data, exists := mfs.ReadFile(filename)
+	if !exists {
+		return
+	}
+	mfs.WriteFile(filename, data[:len(data)/2])
 }
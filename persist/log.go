@@ -0,0 +1,239 @@
+package persist
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// recordHeaderSize is the length of the uint32 length field plus the
+// uint32 crc32 field that precede every record's JSON payload.
+const recordHeaderSize = 8
+
+// maxRecordSize bounds how large a single record's length prefix is
+// allowed to claim to be, before Replay has any other way to know the
+// prefix is genuine. Without this, a bit-flipped or torn length field at
+// the tail of the log - exactly the crash-recovery case Replay exists to
+// handle - could claim a multi-gigabyte payload and OOM the process
+// trying to allocate it.
+const maxRecordSize = 64 << 20 // 64 MiB
+
+// LogOptions configures the optional behavior of a Log.
+type LogOptions struct {
+	// SyncOnAppend makes Append fsync the log file before returning, so
+	// that a crash immediately after Append cannot lose the record.
+	// Subsystems that Append very frequently (e.g. once per contract
+	// revision) usually leave this off and rely on Compact's snapshot
+	// for durability instead.
+	SyncOnAppend bool
+}
+
+// Log is an append-only journal of checksummed JSON records, for
+// persisted state that changes too often to justify a full SaveJSON
+// rewrite on every update (e.g. renter contract spending, host revenue,
+// wallet seed progress). Callers Append records as they happen and
+// occasionally Compact the log down to a single snapshot written via the
+// existing SaveJSON atomic-rename path.
+//
+// Each record on disk is:
+//
+//	uint32 length || uint32 crc32(json) || json
+//
+// so that Replay can recognize a torn write at the tail of the log - the
+// signature of a crash mid-Append - and treat it as end-of-log rather
+// than an error, the way a WAL does after a crash.
+type Log struct {
+	fs               FS
+	file             File
+	logFilename      string
+	snapshotFilename string
+	meta             Metadata
+	opts             LogOptions
+}
+
+// NewLog opens (creating if necessary) the log at logFilename for
+// appending, using fs. snapshotFilename and meta are used by Compact when
+// writing a new snapshot via SaveJSON.
+func NewLog(fs FS, meta Metadata, snapshotFilename, logFilename string, opts LogOptions) (*Log, error) {
+	f, err := fs.OpenFile(logFilename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{
+		fs:               fs,
+		file:             f,
+		logFilename:      logFilename,
+		snapshotFilename: snapshotFilename,
+		meta:             meta,
+		opts:             opts,
+	}, nil
+}
+
+// Close closes the log's underlying file handle.
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// Append marshals v to JSON and appends it to the log as a single
+// length-prefixed, checksummed record. If opts.SyncOnAppend was set in
+// NewLog, Append fsyncs the log file before returning.
+func (l *Log) Append(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	rec := make([]byte, recordHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(data))
+	copy(rec[recordHeaderSize:], data)
+
+	if _, err := l.file.Write(rec); err != nil {
+		return err
+	}
+	if l.opts.SyncOnAppend {
+		return l.file.Sync()
+	}
+	return nil
+}
+
+// Replay reads the log from the beginning, calling fn with each record's
+// raw JSON payload in append order. It stops and returns nil as soon as
+// it hits a record that is torn, short, oversized, or fails its crc32
+// check, treating that point as the effective end of the log rather than
+// an error - exactly what a crash mid-Append leaves behind. If fn itself
+// returns an error, Replay stops and returns it immediately.
+func (l *Log) Replay(fn func(raw json.RawMessage) error) error {
+	return l.ReplaySince(0, fn)
+}
+
+// ReplaySince is Replay, except it skips the first offset bytes of the
+// log before replaying. LoadSnapshot returns the offset a Compact-written
+// snapshot corresponds to; replaying from that offset instead of from the
+// start is what lets a restart skip records the snapshot already reflects
+// instead of double-applying them. If offset is beyond the log's current
+// length - because the log was truncated by a Compact that completed
+// after the snapshot's offset was recorded - it is treated as 0: nothing
+// in a shorter, newer generation of the log can have been reflected by an
+// older snapshot.
+func (l *Log) ReplaySince(offset int64, fn func(raw json.RawMessage) error) error {
+	f, err := l.fs.OpenFile(l.logFilename, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := l.fs.Stat(l.logFilename)
+	if err != nil {
+		return err
+	}
+	remaining := info.Size()
+	if offset > remaining {
+		offset = 0
+	}
+	if offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, f, offset); err != nil {
+			return nil
+		}
+		remaining -= offset
+	}
+
+	header := make([]byte, recordHeaderSize)
+	for {
+		if remaining < recordHeaderSize {
+			// Not enough left for another header: a clean EOF and a torn
+			// header both end replay the same way, since there's nothing
+			// more that was durably appended.
+			return nil
+		}
+		if _, err := io.ReadFull(f, header); err != nil {
+			return nil
+		}
+		remaining -= recordHeaderSize
+		length := binary.LittleEndian.Uint32(header[0:4])
+		wantCRC := binary.LittleEndian.Uint32(header[4:8])
+
+		if length > maxRecordSize || int64(length) > remaining {
+			// The claimed length is either absurd or longer than what's
+			// left in the file - either way the payload was never fully
+			// written, so allocating length bytes to read it would be
+			// both wrong and, for an absurd value, a good way to OOM.
+			return nil
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(f, data); err != nil {
+			return nil
+		}
+		remaining -= int64(length)
+		if crc32.ChecksumIEEE(data) != wantCRC {
+			return nil
+		}
+		if err := fn(json.RawMessage(data)); err != nil {
+			return err
+		}
+	}
+}
+
+// logSnapshot is the shape Compact actually writes to snapshotFilename via
+// SaveJSONWithFS: the caller's snapshot alongside the log's byte length at
+// the moment it was taken. LoadSnapshot returns that length as an offset
+// so a restart can resume replay from it, rather than from the start of
+// the log, regardless of whether Compact's subsequent truncation of the
+// log completed before the process died.
+type logSnapshot struct {
+	Offset int64           `json:"offset"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// LoadSnapshot loads the snapshot most recently written by Compact into v,
+// and returns the log offset it was taken at. Callers should replay with
+// ReplaySince(offset, fn) rather than Replay(fn) after loading a
+// snapshot, so that records the snapshot already captured aren't
+// double-applied.
+func (l *Log) LoadSnapshot(v interface{}) (int64, error) {
+	var wrapped logSnapshot
+	if err := LoadJSONWithFS(l.fs, l.meta, &wrapped, l.snapshotFilename); err != nil {
+		return 0, err
+	}
+	return wrapped.Offset, json.Unmarshal(wrapped.Data, v)
+}
+
+// Compact atomically writes snapshot as the log's snapshot file, tagged
+// with the log's current byte length, then truncates the log so that
+// future Replay calls only have to walk records written since the last
+// compaction.
+//
+// The snapshot write and the log truncation are not a single atomic
+// operation: if the process dies between them, the snapshot is durable
+// but the full, untruncated log is still on disk too. That's why the
+// snapshot records the log length it was taken at instead of relying on
+// truncation having happened - LoadSnapshot's offset tells a restart
+// exactly how much of whatever log it finds was already folded into the
+// snapshot, whether or not the truncation that was supposed to remove
+// that prefix ever completed.
+func (l *Log) Compact(snapshot interface{}) error {
+	info, err := l.fs.Stat(l.logFilename)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	wrapped := logSnapshot{Offset: info.Size(), Data: data}
+	if err := SaveJSONWithFS(l.fs, l.meta, wrapped, l.snapshotFilename); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	f, err := l.fs.OpenFile(l.logFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	return nil
+}
@@ -0,0 +1,187 @@
+package persist
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileData is the backing store for a single MemFS file. It is shared by
+// pointer between every handle opened against the same name, so that a
+// Write through one handle is immediately visible to a Read through
+// another - the way writes to a real file are visible to any other file
+// descriptor on the same inode without requiring a Close first. This
+// matters for persist.Log, whose Append keeps a handle open indefinitely
+// while Replay opens its own.
+type fileData struct {
+	data []byte
+}
+
+// MemFS is an in-memory FS implementation. It lets tests exercise
+// SaveJSON/LoadJSON's atomic-rename and recovery logic, and persist.Log's
+// append/replay logic, without touching disk. It is also the backing FS
+// that FaultFS wraps to inject failures.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*fileData
+}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*fileData),
+	}
+}
+
+// memFile is the handle returned by MemFS.OpenFile.
+type memFile struct {
+	fs         *MemFS
+	fd         *fileData
+	pos        int
+	appendMode bool
+	readOnly   bool
+}
+
+// Read implements File.Read.
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.pos >= len(f.fd.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.fd.data[f.pos:])
+	f.pos += n
+	return n, nil
+}
+
+// Write implements File.Write.
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.readOnly {
+		return 0, os.ErrPermission
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.appendMode {
+		f.pos = len(f.fd.data)
+	}
+	end := f.pos + len(p)
+	if end > len(f.fd.data) {
+		grown := make([]byte, end)
+		copy(grown, f.fd.data)
+		f.fd.data = grown
+	}
+	copy(f.fd.data[f.pos:end], p)
+	f.pos = end
+	return len(p), nil
+}
+
+// Sync implements File.Sync. MemFS has no write-back cache of its own;
+// every Write is already visible to other handles, so Sync is a no-op.
+func (f *memFile) Sync() error {
+	return nil
+}
+
+// Close implements File.Close.
+func (f *memFile) Close() error {
+	return nil
+}
+
+// OpenFile implements FS.OpenFile.
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fd, exists := fs.files[name]
+	if !exists {
+		if flag&os.O_CREATE == 0 {
+			return nil, os.ErrNotExist
+		}
+		fd = &fileData{}
+		fs.files[name] = fd
+	}
+	if flag&os.O_TRUNC != 0 {
+		fd.data = nil
+	}
+	pos := 0
+	if flag&os.O_APPEND != 0 {
+		pos = len(fd.data)
+	}
+	readOnly := flag&(os.O_WRONLY|os.O_RDWR) == 0
+	return &memFile{fs: fs, fd: fd, pos: pos, appendMode: flag&os.O_APPEND != 0, readOnly: readOnly}, nil
+}
+
+// Remove implements FS.Remove.
+func (fs *MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, exists := fs.files[name]; !exists {
+		return os.ErrNotExist
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+// Rename implements FS.Rename.
+func (fs *MemFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fd, exists := fs.files[oldname]
+	if !exists {
+		return os.ErrNotExist
+	}
+	fs.files[newname] = fd
+	delete(fs.files, oldname)
+	return nil
+}
+
+// Stat implements FS.Stat.
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fd, exists := fs.files[name]
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+	return memFileInfo{name: name, size: int64(len(fd.data))}, nil
+}
+
+// SyncDir implements FS.SyncDir. MemFS has no concept of directory
+// entries separate from the files map, so there's nothing to flush; like
+// Sync, this is a no-op that exists so FaultFS can still inject a failure
+// into it for tests that want to simulate one.
+func (fs *MemFS) SyncDir(dir string) error {
+	return nil
+}
+
+// WriteFile is a test convenience that sets the full contents of name in
+// a single call, regardless of whether it already exists.
+func (fs *MemFS) WriteFile(name string, data []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[name] = &fileData{data: append([]byte{}, data...)}
+}
+
+// ReadFile is a test convenience that returns the full contents of name.
+func (fs *MemFS) ReadFile(name string) ([]byte, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fd, exists := fs.files[name]
+	if !exists {
+		return nil, false
+	}
+	return append([]byte{}, fd.data...), true
+}
+
+// memFileInfo is a minimal os.FileInfo implementation for MemFS.
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0600 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
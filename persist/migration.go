@@ -0,0 +1,157 @@
+package persist
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNoMigrationPath is returned when a file's on-disk version is older
+// than the version the caller expects, but no chain of registered
+// migrations connects the two.
+var ErrNoMigrationPath = errors.New("persist: no migration path to the requested version")
+
+// migrationEdge is one step in a header's migration graph: applying fn to
+// data written at version "from" produces data valid at version "to".
+type migrationEdge struct {
+	to string
+	fn func(raw []byte) ([]byte, error)
+}
+
+var (
+	migrationsMu sync.Mutex
+	// migrations is keyed by header and then by the version a file was
+	// written at, so that LoadJSONWithFS can walk forward one step at a
+	// time until it reaches the version the caller expects.
+	migrations = make(map[string]map[string]migrationEdge)
+)
+
+// RegisterMigration records that data for the given header, persisted at
+// version "from", can be upgraded to version "to" by calling fn on the
+// raw codec-encoded data (not the fileHeader container around it; for
+// files written by JSONCodec, that data is JSON). LoadJSON chains
+// migrations together, so registering v1->v2 and v2->v3 is enough to
+// upgrade a v1 file all the way to v3.
+//
+// RegisterMigration is meant to be called from init(), mirroring how
+// modules register their persisted struct's Metadata once at startup.
+// Registering a second migration for the same (header, from) pair is
+// almost certainly a mistake - it makes the upgrade path ambiguous - so
+// it panics rather than silently overwriting the first.
+func RegisterMigration(header, from, to string, fn func(raw []byte) ([]byte, error)) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	edges, ok := migrations[header]
+	if !ok {
+		edges = make(map[string]migrationEdge)
+		migrations[header] = edges
+	}
+	if _, exists := edges[from]; exists {
+		panic("persist: duplicate migration registered for header " + header + " from version " + from)
+	}
+	edges[from] = migrationEdge{to: to, fn: fn}
+}
+
+// migrate walks the migration graph registered for header, applying
+// successive migrations to data until it reaches version "to" starting
+// from version "from". If nothing has ever been registered for header,
+// it returns ErrBadVersion, matching the hard-error behavior callers
+// relied on before migrations existed. If some migrations are
+// registered but none of them lead to "to", it returns
+// ErrNoMigrationPath.
+func migrate(header, from, to string, data []byte) ([]byte, error) {
+	migrationsMu.Lock()
+	edges, hasAny := migrations[header]
+	migrationsMu.Unlock()
+	if !hasAny {
+		return nil, ErrBadVersion
+	}
+
+	version := from
+	for version != to {
+		migrationsMu.Lock()
+		edge, ok := edges[version]
+		migrationsMu.Unlock()
+		if !ok {
+			return nil, ErrNoMigrationPath
+		}
+		upgraded, err := edge.fn(data)
+		if err != nil {
+			return nil, err
+		}
+		data = upgraded
+		version = edge.to
+	}
+	return data, nil
+}
+
+// MigrationPlan reports what Migrate found for a persisted file, without
+// writing anything: the version it's currently at and the version the
+// registered migration graph would carry it to.
+type MigrationPlan struct {
+	CurrentVersion string
+	TargetVersion  string
+	UpToDate       bool
+}
+
+// Migrate is a dry-run helper for tools like siac: it reports whether the
+// persisted file at path is at targetMeta's version already, and if not,
+// confirms a migration path exists and what version it leads to, without
+// writing anything to path. Use ApplyMigration to actually perform the
+// upgrade.
+func Migrate(path string, targetMeta Metadata) (MigrationPlan, error) {
+	return MigrateWithFS(defaultFS, path, targetMeta)
+}
+
+// MigrateWithFS is Migrate using a caller-supplied FS, for testing.
+func MigrateWithFS(fs FS, path string, targetMeta Metadata) (MigrationPlan, error) {
+	hdr, data, _, err := loadContainer(fs, targetMeta.Header, path)
+	if err != nil {
+		return MigrationPlan{}, err
+	}
+	plan := MigrationPlan{CurrentVersion: hdr.Version, TargetVersion: targetMeta.Version}
+	if hdr.Version == targetMeta.Version {
+		plan.UpToDate = true
+		return plan, nil
+	}
+	// Migrate a copy of the raw data just to confirm a path exists and
+	// report any error; the result is discarded, so path is never
+	// touched.
+	if _, err := migrate(targetMeta.Header, hdr.Version, targetMeta.Version, append([]byte(nil), data...)); err != nil {
+		return plan, err
+	}
+	return plan, nil
+}
+
+// ApplyMigration upgrades the persisted file at path to targetMeta's
+// version using the registered migration graph, without requiring the
+// caller to know the concrete Go type the data decodes to - it operates
+// on the raw encoded data instead of round-tripping through an object, and
+// keeps the codec name the file was written with. This makes
+// it usable from tools like siac, which want to upgrade a node's
+// persisted files without linking in every module's struct definitions.
+// Callers that want to know what ApplyMigration would do before it does
+// it should call Migrate first.
+func ApplyMigration(path string, targetMeta Metadata) error {
+	return ApplyMigrationWithFS(defaultFS, path, targetMeta)
+}
+
+// ApplyMigrationWithFS is ApplyMigration using a caller-supplied FS, for
+// testing.
+func ApplyMigrationWithFS(fs FS, path string, targetMeta Metadata) error {
+	hdr, data, foundAt, err := loadContainer(fs, targetMeta.Header, path)
+	if err != nil {
+		return err
+	}
+	if hdr.Version == targetMeta.Version {
+		if foundAt != path {
+			return fs.Rename(foundAt, path)
+		}
+		return nil
+	}
+	data, err = migrate(targetMeta.Header, hdr.Version, targetMeta.Version, data)
+	if err != nil {
+		return err
+	}
+	return writeContainer(fs, targetMeta, hdr.Codec, data, path)
+}